@@ -0,0 +1,101 @@
+package blobs
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Content store labels under which a layer's BlobInfo is recorded when it
+// is first written, so that later callers can avoid re-sniffing the blob to
+// learn its media type.
+const (
+	compressionLabel = "buildkit.io/compression.type"
+	mediaTypeLabel   = "buildkit.io/compression.mediatype"
+	diffIDLabel      = "buildkit.io/compression.diffid"
+)
+
+// BlobInfo describes everything downstream exporters need to know about a
+// layer blob without re-opening and re-sniffing it. It is recorded alongside
+// the blob when it is first written via SetBlobInfo, mirroring how
+// containers/image's copy pipeline threads BlobInfo.Compression through a
+// copy instead of re-detecting it at every step.
+type BlobInfo struct {
+	Digest      digest.Digest
+	DiffID      digest.Digest
+	Size        int64
+	Compression CompressionType
+	MediaType   string
+}
+
+// SetBlobInfo records info as content store labels on info.Digest, so that
+// GetBlobInfo and GetMediaTypeForLayers can read it back later instead of
+// re-deriving it from blob content.
+func SetBlobInfo(ctx context.Context, cs content.Store, info BlobInfo) error {
+	cinfo, err := cs.Info(ctx, info.Digest)
+	if err != nil {
+		return err
+	}
+
+	if cinfo.Labels == nil {
+		cinfo.Labels = map[string]string{}
+	}
+	cinfo.Labels[compressionLabel] = info.Compression.String()
+	cinfo.Labels[mediaTypeLabel] = info.MediaType
+	if info.DiffID != "" {
+		cinfo.Labels[diffIDLabel] = info.DiffID.String()
+	}
+
+	_, err = cs.Update(ctx, cinfo, "labels."+compressionLabel, "labels."+mediaTypeLabel, "labels."+diffIDLabel)
+	return err
+}
+
+// GetBlobInfo reads back the BlobInfo recorded by SetBlobInfo. A blob that
+// predates this label set (a legacy blob) comes back with Compression
+// UnknownCompression and an empty MediaType; callers should treat that as a
+// signal to fall back to DetectLayerMediaType.
+func GetBlobInfo(ctx context.Context, cs content.Store, dgst digest.Digest) (BlobInfo, error) {
+	cinfo, err := cs.Info(ctx, dgst)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	bi := BlobInfo{
+		Digest:      dgst,
+		Size:        cinfo.Size,
+		Compression: UnknownCompression,
+		MediaType:   cinfo.Labels[mediaTypeLabel],
+	}
+	if v, ok := cinfo.Labels[compressionLabel]; ok {
+		for ct := Uncompressed; ct <= Encrypted; ct++ {
+			if ct.String() == v {
+				bi.Compression = ct
+				break
+			}
+		}
+	}
+	if v, ok := cinfo.Labels[diffIDLabel]; ok {
+		bi.DiffID = digest.Digest(v)
+	}
+	return bi, nil
+}
+
+// SetBlobCompression stamps just the compression type of an already-written
+// blob, for converters that (de)compress a layer in place and need to
+// record its new compression atomically without rebuilding the rest of its
+// BlobInfo.
+func SetBlobCompression(ctx context.Context, cs content.Store, dgst digest.Digest, ct CompressionType) error {
+	info, err := cs.Info(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	if info.Labels == nil {
+		info.Labels = map[string]string{}
+	}
+	info.Labels[compressionLabel] = ct.String()
+
+	_, err = cs.Update(ctx, info, "labels."+compressionLabel)
+	return err
+}
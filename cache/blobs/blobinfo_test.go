@@ -0,0 +1,139 @@
+package blobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeContentStore is a minimal in-memory content.Store backing only Info
+// and Update, which is all SetBlobInfo/GetBlobInfo/SetBlobCompression need.
+type fakeContentStore struct {
+	infos map[digest.Digest]content.Info
+}
+
+func newFakeContentStore() *fakeContentStore {
+	return &fakeContentStore{infos: map[digest.Digest]content.Info{}}
+}
+
+func (s *fakeContentStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, ok := s.infos[dgst]
+	if !ok {
+		return content.Info{}, errors.New("not found")
+	}
+	return info, nil
+}
+
+func (s *fakeContentStore) Update(ctx context.Context, info content.Info, fieldpaths ...string) (content.Info, error) {
+	existing := s.infos[info.Digest]
+	existing.Digest = info.Digest
+	if info.Size != 0 {
+		existing.Size = info.Size
+	}
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	for k, v := range info.Labels {
+		existing.Labels[k] = v
+	}
+	s.infos[info.Digest] = existing
+	return existing, nil
+}
+
+func (s *fakeContentStore) Walk(ctx context.Context, fn content.WalkFunc, filters ...string) error {
+	return errors.New("not implemented")
+}
+
+func (s *fakeContentStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	return errors.New("not implemented")
+}
+
+func (s *fakeContentStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) Status(ctx context.Context, ref string) (content.Status, error) {
+	return content.Status{}, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) ListStatuses(ctx context.Context, filters ...string) ([]content.Status, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (s *fakeContentStore) Abort(ctx context.Context, ref string) error {
+	return errors.New("not implemented")
+}
+
+func TestBlobInfoRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	cs := newFakeContentStore()
+	dgst := digest.FromString("layer-content")
+	cs.infos[dgst] = content.Info{Digest: dgst, Size: 1234}
+
+	want := BlobInfo{
+		Digest:      dgst,
+		DiffID:      digest.FromString("diff-id"),
+		Size:        1234,
+		Compression: Zstd,
+		MediaType:   mediaTypeImageLayerZstd,
+	}
+	if err := SetBlobInfo(ctx, cs, want); err != nil {
+		t.Fatalf("SetBlobInfo() error = %v", err)
+	}
+
+	got, err := GetBlobInfo(ctx, cs, dgst)
+	if err != nil {
+		t.Fatalf("GetBlobInfo() error = %v", err)
+	}
+	if got != want {
+		t.Fatalf("GetBlobInfo() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetBlobInfoLegacyBlob(t *testing.T) {
+	ctx := context.Background()
+	cs := newFakeContentStore()
+	dgst := digest.FromString("legacy-layer")
+	cs.infos[dgst] = content.Info{Digest: dgst, Size: 42}
+
+	got, err := GetBlobInfo(ctx, cs, dgst)
+	if err != nil {
+		t.Fatalf("GetBlobInfo() error = %v", err)
+	}
+	if got.Compression != UnknownCompression {
+		t.Fatalf("Compression = %s, want UnknownCompression for a blob with no recorded label", got.Compression)
+	}
+	if got.MediaType != "" {
+		t.Fatalf("MediaType = %q, want empty for a blob with no recorded label", got.MediaType)
+	}
+}
+
+func TestSetBlobCompressionStampsCompressionOnly(t *testing.T) {
+	ctx := context.Background()
+	cs := newFakeContentStore()
+	dgst := digest.FromString("converted-layer")
+	cs.infos[dgst] = content.Info{Digest: dgst}
+
+	if err := SetBlobCompression(ctx, cs, dgst, Gzip); err != nil {
+		t.Fatalf("SetBlobCompression() error = %v", err)
+	}
+
+	got, err := GetBlobInfo(ctx, cs, dgst)
+	if err != nil {
+		t.Fatalf("GetBlobInfo() error = %v", err)
+	}
+	if got.Compression != Gzip {
+		t.Fatalf("Compression = %s, want %s", got.Compression, Gzip)
+	}
+	if got.MediaType != "" {
+		t.Fatalf("MediaType = %q, want empty: SetBlobCompression only stamps compression", got.MediaType)
+	}
+}
@@ -1,12 +1,10 @@
 package blobs
 
 import (
-	"bytes"
 	"context"
 	"io"
 
 	"github.com/containerd/containerd/content"
-	"github.com/containerd/containerd/images"
 	"github.com/moby/buildkit/cache"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -24,10 +22,40 @@ const (
 	// Gzip is used for blob data.
 	Gzip
 
+	// Estargz is gzip-compressed blob data carrying an eStargz TOC,
+	// enabling lazy pulls of the layer.
+	Estargz
+
+	// Zstd is used for blob data.
+	Zstd
+
+	// ZstdChunked is zstd-compressed blob data carrying a containers/storage
+	// zstd:chunked manifest, enabling lazy, chunk-level pulls of the layer.
+	ZstdChunked
+
+	// Encrypted indicates the blob is wrapped in an ocicrypt envelope (PGP
+	// or JWE). Its inner compression cannot be determined without the
+	// decryption keys.
+	Encrypted
+
 	// UnknownCompression means not supported yet.
 	UnknownCompression CompressionType = -1
 )
 
+// mediaTypeImageLayerZstd is the OCI media type for a zstd-compressed layer.
+// Docker schema 2 has no zstd variant, so there is no Docker equivalent.
+const mediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+// Encrypted layer media types, as defined by containers/ocicrypt.
+const (
+	mediaTypeImageLayerEnc             = "application/vnd.oci.image.layer.v1.tar+encrypted"
+	mediaTypeImageLayerGzipEnc         = "application/vnd.oci.image.layer.v1.tar+gzip+encrypted"
+	mediaTypeDockerSchema2LayerEnc     = "application/vnd.docker.image.rootfs.diff.tar.encrypted"
+	mediaTypeDockerSchema2LayerGzipEnc = "application/vnd.docker.image.rootfs.diff.tar.gzip.encrypted"
+)
+
+// DefaultCompression is the compression type this package's callers fall
+// back to when they don't request one explicitly.
 var DefaultCompression = Gzip
 
 func (ct CompressionType) String() string {
@@ -36,6 +64,14 @@ func (ct CompressionType) String() string {
 		return "uncompressed"
 	case Gzip:
 		return "gzip"
+	case Estargz:
+		return "estargz"
+	case Zstd:
+		return "zstd"
+	case ZstdChunked:
+		return "zstd:chunked"
+	case Encrypted:
+		return "encrypted"
 	default:
 		return "unknown"
 	}
@@ -54,23 +90,29 @@ func DetectLayerMediaType(ctx context.Context, cs content.Store, id digest.Diges
 		return "", err
 	}
 
-	switch ct {
-	case Uncompressed:
-		if oci {
-			return ocispec.MediaTypeImageLayer, nil
-		}
-		return images.MediaTypeDockerSchema2Layer, nil
-	case Gzip:
-		if oci {
-			return ocispec.MediaTypeImageLayerGzip, nil
+	if ct == Encrypted {
+		return "", errors.Errorf("cannot detect media type for encrypted layer %v from content alone; use the recorded BlobInfo instead", id)
+	}
+
+	c, err := getCompressor(ct)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to detect layer %v compression type", id)
+	}
+
+	if oci {
+		if mt := c.OCIMediaType(); mt != "" {
+			return mt, nil
 		}
-		return images.MediaTypeDockerSchema2LayerGzip, nil
-	default:
-		return "", errors.Errorf("failed to detect layer %v compression type", id)
+		return "", errors.Errorf("compression type %s has no OCI media type", ct)
+	}
+	if mt := c.DockerMediaType(); mt != "" {
+		return mt, nil
 	}
+	return "", errors.Errorf("compression type %s is not supported for docker schema 2 layer %v", ct, id)
 }
 
-// detectCompressionType detects compression type from real blob data.
+// detectCompressionType detects compression type from real blob data by
+// matching it against the registered compressors.
 func detectCompressionType(cr io.Reader) (CompressionType, error) {
 	var buf [10]byte
 	var n int
@@ -86,14 +128,14 @@ func detectCompressionType(cr io.Reader) (CompressionType, error) {
 		return UnknownCompression, err
 	}
 
-	for c, m := range map[CompressionType][]byte{
-		Gzip: {0x1F, 0x8B, 0x08},
-	} {
-		if n < len(m) {
+	for _, c := range compressors {
+		// Uncompressed always matches, so skip it until everything else has
+		// had a chance to.
+		if c.Type() == Uncompressed {
 			continue
 		}
-		if bytes.Equal(m, buf[:len(m)]) {
-			return c, nil
+		if c.Match(buf[:n]) {
+			return c.Type(), nil
 		}
 	}
 	return Uncompressed, nil
@@ -103,7 +145,15 @@ func detectCompressionType(cr io.Reader) (CompressionType, error) {
 // If there is a mismatch in diff IDs or blobsums between the diffPairs and
 // corresponding ref, the returned slice will have an empty media type for
 // that layer and all parents.
-func GetMediaTypeForLayers(diffPairs []DiffPair, ref cache.ImmutableRef) []string {
+//
+// The media type is taken from the ref's recorded info, falling back to the
+// BlobInfo recorded on the blob via SetBlobInfo, wherever possible rather
+// than re-derived from blob content. This is required for encrypted layers,
+// whose on-disk bytes no longer match any known compression magic, and it
+// avoids repeated I/O on hot export paths for everything else. Only a
+// legacy blob with neither a recorded media type nor a recorded BlobInfo
+// falls back to DetectLayerMediaType.
+func GetMediaTypeForLayers(ctx context.Context, cs content.Store, diffPairs []DiffPair, ref cache.ImmutableRef, oci bool) []string {
 	layerTypes := make([]string, len(diffPairs))
 	if ref == nil {
 		return layerTypes
@@ -119,7 +169,31 @@ func GetMediaTypeForLayers(diffPairs []DiffPair, ref cache.ImmutableRef) []strin
 		if !(info.DiffID == dp.DiffID && info.Blob == dp.Blobsum) {
 			break
 		}
-		layerTypes[len(diffPairs)-1-i] = info.MediaType
+
+		mt := info.MediaType
+		if mt == "" {
+			if bi, err := GetBlobInfo(ctx, cs, dp.Blobsum); err == nil {
+				if bi.MediaType != "" {
+					mt = bi.MediaType
+				} else if bi.Compression != UnknownCompression {
+					if c, cerr := getCompressor(bi.Compression); cerr == nil {
+						if oci {
+							mt = c.OCIMediaType()
+						} else {
+							mt = c.DockerMediaType()
+						}
+					}
+				}
+			}
+		}
+		if mt == "" {
+			// Legacy blob with no recorded BlobInfo; fall back to sniffing
+			// it once.
+			if detected, err := DetectLayerMediaType(ctx, cs, dp.Blobsum, oci); err == nil {
+				mt = detected
+			}
+		}
+		layerTypes[len(diffPairs)-1-i] = mt
 
 		parent := tref.Parent()
 		tref.Release(context.TODO())
@@ -134,30 +208,72 @@ func GetMediaTypeForLayers(diffPairs []DiffPair, ref cache.ImmutableRef) []strin
 	return layerTypes
 }
 
-var toDockerLayerType = map[string]string{
-	ocispec.MediaTypeImageLayer:            images.MediaTypeDockerSchema2Layer,
-	images.MediaTypeDockerSchema2Layer:     images.MediaTypeDockerSchema2Layer,
-	ocispec.MediaTypeImageLayerGzip:        images.MediaTypeDockerSchema2LayerGzip,
-	images.MediaTypeDockerSchema2LayerGzip: images.MediaTypeDockerSchema2LayerGzip,
+// compressorForMediaType finds the registered compressor that claims to be
+// able to convert a layer away from mediaType.
+func compressorForMediaType(mediaType string) Compressor {
+	for _, c := range compressors {
+		if c.CanConvertManifest(mediaType) {
+			return c
+		}
+	}
+	return nil
 }
 
-var toOCILayerType = map[string]string{
-	ocispec.MediaTypeImageLayer:            ocispec.MediaTypeImageLayer,
-	images.MediaTypeDockerSchema2Layer:     ocispec.MediaTypeImageLayer,
-	ocispec.MediaTypeImageLayerGzip:        ocispec.MediaTypeImageLayerGzip,
-	images.MediaTypeDockerSchema2LayerGzip: ocispec.MediaTypeImageLayerGzip,
+// encryptedOCIToDocker maps each OCI encrypted layer media type to its
+// Docker-flavored equivalent, and vice versa via the reversed lookup below.
+var encryptedOCIToDocker = map[string]string{
+	mediaTypeImageLayerEnc:     mediaTypeDockerSchema2LayerEnc,
+	mediaTypeImageLayerGzipEnc: mediaTypeDockerSchema2LayerGzipEnc,
 }
 
-func ConvertLayerMediaType(mediaType string, oci bool) string {
-	var converted string
+var encryptedDockerToOCI = map[string]string{
+	mediaTypeDockerSchema2LayerEnc:     mediaTypeImageLayerEnc,
+	mediaTypeDockerSchema2LayerGzipEnc: mediaTypeImageLayerGzipEnc,
+}
+
+// ConvertLayerMediaType converts mediaType to its OCI or Docker schema 2
+// equivalent. It returns an error if mediaType is an encrypted layer being
+// converted across the OCI/Docker boundary, since the inner compression
+// cannot be inspected without the decryption keys.
+func ConvertLayerMediaType(mediaType string, oci bool) (string, error) {
+	if _, ok := encryptedOCIToDocker[mediaType]; ok {
+		if oci {
+			return mediaType, nil
+		}
+		return "", errors.Errorf("cannot convert encrypted layer %q to a docker media type without decryption keys", mediaType)
+	}
+	if _, ok := encryptedDockerToOCI[mediaType]; ok {
+		if !oci {
+			return mediaType, nil
+		}
+		return "", errors.Errorf("cannot convert encrypted layer %q to an OCI media type without decryption keys", mediaType)
+	}
+
+	c := compressorForMediaType(mediaType)
+	if c == nil {
+		logrus.Warnf("unhandled conversion for mediatype %q", mediaType)
+		return mediaType, nil
+	}
+
 	if oci {
-		converted = toOCILayerType[mediaType]
-	} else {
-		converted = toDockerLayerType[mediaType]
+		if mt := c.OCIMediaType(); mt != "" {
+			return mt, nil
+		}
+		logrus.Warnf("unhandled OCI conversion for mediatype %q", mediaType)
+		return mediaType, nil
+	}
+
+	if mt := c.DockerMediaType(); mt != "" {
+		return mt, nil
 	}
-	if converted == "" {
+
+	// Docker schema 2 cannot represent this compression (e.g. zstd), so fall
+	// back to gzip rather than failing the whole conversion.
+	gz, err := getCompressor(Gzip)
+	if err != nil {
 		logrus.Warnf("unhandled conversion for mediatype %q", mediaType)
-		return mediaType
+		return mediaType, nil
 	}
-	return converted
+	logrus.Warnf("docker schema 2 does not support %s, converting %q to gzip", c.Type(), mediaType)
+	return gz.DockerMediaType(), nil
 }
@@ -0,0 +1,244 @@
+package blobs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/containerd/containerd/images"
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compressor describes a pluggable compression format that DetectLayerMediaType
+// and ConvertLayerMediaType can dispatch to. Implementations are registered
+// with RegisterCompressor at init time.
+type Compressor interface {
+	// Type is the CompressionType this implementation handles.
+	Type() CompressionType
+
+	// OCIMediaType returns the OCI layer media type for this compressor, or
+	// "" if it cannot be represented as an OCI layer.
+	OCIMediaType() string
+
+	// DockerMediaType returns the Docker schema 2 layer media type for this
+	// compressor, or "" if Docker schema 2 has no equivalent.
+	DockerMediaType() string
+
+	// Match reports whether buf, the first bytes of a blob, is encoded in
+	// this compressor's format.
+	Match(buf []byte) bool
+
+	// NewReader wraps r with a decompressing reader.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+
+	// NewWriter wraps w with a compressing writer.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// CanConvertManifest reports whether mediaType is one of this
+	// compressor's own layer media types, so that ConvertLayerMediaType can
+	// map it to this compressor's OCI or Docker media type without
+	// re-inspecting the blob. It returns false where that mapping is not
+	// safe, such as for an encrypted layer.
+	CanConvertManifest(mediaType string) bool
+}
+
+// compressors holds the registered compressors in registration order. Order
+// matters for Match: more specific matchers should be registered before more
+// general ones.
+var compressors []Compressor
+
+// compressorByType indexes compressors by their CompressionType for fast
+// lookup from ConvertLayerMediaType and friends.
+var compressorByType = map[CompressionType]Compressor{}
+
+// RegisterCompressor makes a Compressor available to DetectLayerMediaType and
+// ConvertLayerMediaType. It is expected to be called from init().
+func RegisterCompressor(c Compressor) {
+	compressors = append(compressors, c)
+	compressorByType[c.Type()] = c
+}
+
+func getCompressor(ct CompressionType) (Compressor, error) {
+	c, ok := compressorByType[ct]
+	if !ok {
+		return nil, errors.Errorf("no compressor registered for compression type %s", ct)
+	}
+	return c, nil
+}
+
+func init() {
+	RegisterCompressor(uncompressedCompressor{})
+	RegisterCompressor(gzipCompressor{})
+	RegisterCompressor(estargzCompressor{})
+	RegisterCompressor(zstdCompressor{})
+	RegisterCompressor(zstdChunkedCompressor{})
+	RegisterCompressor(encryptedCompressor{})
+}
+
+type uncompressedCompressor struct{}
+
+func (uncompressedCompressor) Type() CompressionType { return Uncompressed }
+func (uncompressedCompressor) OCIMediaType() string  { return ocispec.MediaTypeImageLayer }
+func (uncompressedCompressor) DockerMediaType() string {
+	return images.MediaTypeDockerSchema2Layer
+}
+func (uncompressedCompressor) Match(buf []byte) bool { return true }
+func (uncompressedCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+func (uncompressedCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+func (uncompressedCompressor) CanConvertManifest(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageLayer || mediaType == images.MediaTypeDockerSchema2Layer
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Type() CompressionType   { return Gzip }
+func (gzipCompressor) OCIMediaType() string    { return ocispec.MediaTypeImageLayerGzip }
+func (gzipCompressor) DockerMediaType() string { return images.MediaTypeDockerSchema2LayerGzip }
+func (gzipCompressor) Match(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte{0x1F, 0x8B, 0x08})
+}
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+func (gzipCompressor) CanConvertManifest(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageLayerGzip || mediaType == images.MediaTypeDockerSchema2LayerGzip
+}
+
+// estargzCompressor handles the eStargz lazy-pull format. On the wire it is
+// plain gzip, so it shares gzip's media types and magic bytes; it is
+// distinguished by the containerd.io/snapshot/stargz/toc.digest annotation
+// carried on the descriptor, which callers that know they are producing or
+// consuming eStargz select explicitly rather than relying on byte sniffing.
+type estargzCompressor struct{}
+
+// EstargzTOCDigestAnnotation is the descriptor annotation that identifies a
+// gzip layer as eStargz and carries the digest of its TOC.
+const EstargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+func (estargzCompressor) Type() CompressionType   { return Estargz }
+func (estargzCompressor) OCIMediaType() string    { return ocispec.MediaTypeImageLayerGzip }
+func (estargzCompressor) DockerMediaType() string { return images.MediaTypeDockerSchema2LayerGzip }
+
+// Match always returns false: eStargz is indistinguishable from gzip at the
+// byte level, so it is only ever selected explicitly (e.g. from a recorded
+// BlobInfo or the TOC annotation), never by magic-byte detection.
+func (estargzCompressor) Match(buf []byte) bool { return false }
+func (estargzCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+func (estargzCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+func (estargzCompressor) CanConvertManifest(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageLayerGzip || mediaType == images.MediaTypeDockerSchema2LayerGzip
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Type() CompressionType { return Zstd }
+func (zstdCompressor) OCIMediaType() string  { return mediaTypeImageLayerZstd }
+
+// DockerMediaType returns "" because Docker schema 2 has no zstd layer type.
+func (zstdCompressor) DockerMediaType() string { return "" }
+func (zstdCompressor) Match(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte{0x28, 0xB5, 0x2F, 0xFD})
+}
+func (zstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+func (zstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+func (zstdCompressor) CanConvertManifest(mediaType string) bool {
+	return mediaType == mediaTypeImageLayerZstd
+}
+
+// ZstdChunkedTOCDigestAnnotation is the descriptor annotation containers/
+// storage's zstd:chunked format uses to carry the checksum of its manifest,
+// the chunk-level index that makes the layer lazy-pullable.
+const ZstdChunkedTOCDigestAnnotation = "io.containers.zstd-chunked.manifest-checksum"
+
+// zstdChunkedCompressor handles containers/storage's zstd:chunked format. On
+// the wire it is plain zstd, so it shares zstd's media type and magic bytes;
+// it is distinguished by the ZstdChunkedTOCDigestAnnotation carried on the
+// descriptor, which callers that know they are producing or consuming
+// zstd:chunked select explicitly rather than relying on byte sniffing -
+// mirroring how estargzCompressor relates to plain gzip.
+type zstdChunkedCompressor struct{}
+
+func (zstdChunkedCompressor) Type() CompressionType { return ZstdChunked }
+func (zstdChunkedCompressor) OCIMediaType() string  { return mediaTypeImageLayerZstd }
+
+// DockerMediaType returns "" because Docker schema 2 has no zstd layer type.
+func (zstdChunkedCompressor) DockerMediaType() string { return "" }
+
+// Match always returns false: zstd:chunked is indistinguishable from plain
+// zstd at the byte level, so it is only ever selected explicitly (e.g. from
+// a recorded BlobInfo or the TOC annotation), never by magic-byte detection.
+func (zstdChunkedCompressor) Match(buf []byte) bool { return false }
+func (zstdChunkedCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+func (zstdChunkedCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+func (zstdChunkedCompressor) CanConvertManifest(mediaType string) bool {
+	return mediaType == mediaTypeImageLayerZstd
+}
+
+// encryptedCompressor matches blobs wrapped in an ocicrypt envelope (PGP or
+// JWE). It never reports a media type of its own: the encrypted OCI/Docker
+// media types are ambiguous about the inner compression (gzip vs
+// uncompressed), so callers must rely on the recorded BlobInfo rather than
+// this compressor to pick one. It exists so detectCompressionType can tell
+// an encrypted blob apart from an unrecognized one.
+type encryptedCompressor struct{}
+
+func (encryptedCompressor) Type() CompressionType   { return Encrypted }
+func (encryptedCompressor) OCIMediaType() string    { return "" }
+func (encryptedCompressor) DockerMediaType() string { return "" }
+
+// Match recognizes the two ocicrypt envelope formats: OpenPGP (old-format
+// packet tag for a public-key encrypted session key, 0x85) and JWE compact
+// serialization (base64 of a JSON header, so it starts with "eyJ").
+func (encryptedCompressor) Match(buf []byte) bool {
+	if len(buf) > 0 && buf[0] == 0x85 {
+		return true
+	}
+	return bytes.HasPrefix(buf, []byte("eyJ"))
+}
+func (encryptedCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return nil, errors.New("cannot read an encrypted layer without decryption keys")
+}
+func (encryptedCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nil, errors.New("cannot write an encrypted layer through the compressor registry")
+}
+
+// CanConvertManifest always returns false: ConvertLayerMediaType refuses
+// encrypted-layer conversion itself via encryptedOCIToDocker/
+// encryptedDockerToOCI before ever consulting the registry, so this
+// compressor is never asked to dispatch a conversion.
+func (encryptedCompressor) CanConvertManifest(mediaType string) bool {
+	return false
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,55 @@
+package blobs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectCompressionType(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		buf  []byte
+		want CompressionType
+	}{
+		{"empty", nil, Uncompressed},
+		{"plain text", []byte("hello world"), Uncompressed},
+		{"gzip", []byte{0x1F, 0x8B, 0x08, 0x00}, Gzip},
+		{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD, 0x00}, Zstd},
+		{"pgp old-format packet", []byte{0x85, 0x01, 0x02}, Encrypted},
+		{"jwe compact serialization", []byte("eyJhbGciOiJBMjU2R0NNS1cifQ"), Encrypted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectCompressionType(bytes.NewReader(tt.buf))
+			if err != nil {
+				t.Fatalf("detectCompressionType() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("detectCompressionType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertLayerMediaTypeZstdDockerFallback(t *testing.T) {
+	got, err := ConvertLayerMediaType(mediaTypeImageLayerZstd, false)
+	if err != nil {
+		t.Fatalf("ConvertLayerMediaType() error = %v", err)
+	}
+	gz, err := getCompressor(Gzip)
+	if err != nil {
+		t.Fatalf("getCompressor(Gzip) error = %v", err)
+	}
+	if want := gz.DockerMediaType(); got != want {
+		t.Fatalf("ConvertLayerMediaType(zstd, oci=false) = %q, want gzip fallback %q", got, want)
+	}
+}
+
+func TestConvertLayerMediaTypeZstdOCIRoundTrip(t *testing.T) {
+	got, err := ConvertLayerMediaType(mediaTypeImageLayerZstd, true)
+	if err != nil {
+		t.Fatalf("ConvertLayerMediaType() error = %v", err)
+	}
+	if got != mediaTypeImageLayerZstd {
+		t.Fatalf("ConvertLayerMediaType(zstd, oci=true) = %q, want %q", got, mediaTypeImageLayerZstd)
+	}
+}
@@ -0,0 +1,38 @@
+package blobs
+
+import "testing"
+
+func TestConvertLayerMediaTypeEncrypted(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		mediaType string
+		oci       bool
+		want      string
+		wantErr   bool
+	}{
+		{"oci gzip+encrypted stays put", mediaTypeImageLayerGzipEnc, true, mediaTypeImageLayerGzipEnc, false},
+		{"oci gzip+encrypted to docker errors", mediaTypeImageLayerGzipEnc, false, "", true},
+		{"oci encrypted stays put", mediaTypeImageLayerEnc, true, mediaTypeImageLayerEnc, false},
+		{"oci encrypted to docker errors", mediaTypeImageLayerEnc, false, "", true},
+		{"docker gzip+encrypted stays put", mediaTypeDockerSchema2LayerGzipEnc, false, mediaTypeDockerSchema2LayerGzipEnc, false},
+		{"docker gzip+encrypted to oci errors", mediaTypeDockerSchema2LayerGzipEnc, true, "", true},
+		{"docker encrypted stays put", mediaTypeDockerSchema2LayerEnc, false, mediaTypeDockerSchema2LayerEnc, false},
+		{"docker encrypted to oci errors", mediaTypeDockerSchema2LayerEnc, true, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConvertLayerMediaType(tt.mediaType, tt.oci)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ConvertLayerMediaType() expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ConvertLayerMediaType() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("ConvertLayerMediaType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package blobs
+
+import (
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/moby/buildkit/cache"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// uncompressedDiffIDAnnotation is the annotation containerd's diff service
+// attaches to a diff descriptor, carrying the digest of the uncompressed
+// contents.
+const uncompressedDiffIDAnnotation = "containerd.io/uncompressed"
+
+// SquashLayers diffs the topmost ref in refs against the parent of the
+// first ref (or scratch, if that parent is nil), streams the result through
+// the compressor registered for compression (or the gzip compressor, when oci
+// is false and Docker schema 2 has no media type for compression), and
+// writes it into cs as a single blob. It returns the resulting descriptor, with its media type
+// picked via ConvertLayerMediaType, and the DiffPair recording the new
+// layer's diff ID and digest.
+//
+// refs is expected to be an ordered parent->child chain, the same shape
+// GetMediaTypeForLayers walks to identify which layers a diffPairs slice
+// covers; the squash range here is simply "everything from refs[0] to the
+// top of refs".
+func SquashLayers(ctx context.Context, cs content.Store, differ diff.Comparer, refs []cache.ImmutableRef, compression CompressionType, oci bool) (ocispec.Descriptor, DiffPair, error) {
+	if len(refs) == 0 {
+		return ocispec.Descriptor{}, DiffPair{}, errors.New("no refs to squash")
+	}
+
+	// Decide the compression we're actually going to write before touching
+	// the content store, so the descriptor we hand back always matches the
+	// bytes on disk under its digest.
+	compression, c, err := resolveSquashCompressor(compression, oci)
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, err
+	}
+
+	lower, lowerDone, err := mountRef(ctx, refs[0].Parent())
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to mount squash base")
+	}
+	defer lowerDone()
+
+	top := refs[len(refs)-1]
+	upper, upperDone, err := mountRef(ctx, top)
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to mount squash target")
+	}
+	defer upperDone()
+
+	// Diff as a plain uncompressed tar; the actual compression is applied
+	// below through the registry so we aren't limited to whichever formats
+	// the differ happens to support natively.
+	diffDesc, err := differ.Compare(ctx, lower, upper, diff.WithMediaType(ocispec.MediaTypeImageLayer))
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to diff squash range")
+	}
+
+	desc, dp, err := compressSquashDiff(ctx, cs, diffDesc, c, compression)
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, err
+	}
+
+	convertedMediaType, err := ConvertLayerMediaType(desc.MediaType, oci)
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, err
+	}
+	desc.MediaType = convertedMediaType
+
+	return desc, dp, nil
+}
+
+// resolveSquashCompressor returns the compressor SquashLayers should
+// actually write through for the requested compression/oci combination,
+// downgrading compression up front when the target manifest flavor can't
+// represent it (e.g. zstd has no Docker schema 2 equivalent), so the
+// descriptor SquashLayers reports always matches the blob it wrote.
+func resolveSquashCompressor(compression CompressionType, oci bool) (CompressionType, Compressor, error) {
+	c, err := getCompressor(compression)
+	if err != nil {
+		return compression, nil, err
+	}
+	if !oci && c.DockerMediaType() == "" {
+		logrus.Warnf("docker schema 2 does not support %s, squashing to gzip instead", compression)
+		compression = Gzip
+		c, err = getCompressor(Gzip)
+		if err != nil {
+			return compression, nil, err
+		}
+	}
+	return compression, c, nil
+}
+
+// countingWriter counts the bytes actually written to w, i.e. the bytes
+// landing in the content store, as opposed to the (generally different)
+// number of bytes a compressing io.Writer was fed.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// compressSquashDiff reads the uncompressed diff at diffDesc, streams it
+// through c.NewWriter into a new blob in cs, and records its BlobInfo via
+// SetBlobInfo.
+func compressSquashDiff(ctx context.Context, cs content.Store, diffDesc ocispec.Descriptor, c Compressor, compression CompressionType) (ocispec.Descriptor, DiffPair, error) {
+	ra, err := cs.ReaderAt(ctx, diffDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to read squash diff")
+	}
+	defer ra.Close()
+
+	w, err := cs.Writer(ctx, content.WithRef("squash-"+diffDesc.Digest.String()))
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to open squash writer")
+	}
+	defer w.Close()
+
+	// cw writes compressed bytes; they must be counted as they land in w; the
+	// number of bytes io.Copy reports below is the uncompressed byte count,
+	// not the compressed size the content store needs for Commit/the
+	// descriptor.
+	cwn := &countingWriter{w: w}
+	cw, err := c.NewWriter(cwn)
+	if err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrapf(err, "failed to create %s writer", compression)
+	}
+
+	if _, err := io.Copy(cw, content.NewReader(ra)); err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to compress squash diff")
+	}
+	if err := cw.Close(); err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to flush squash diff")
+	}
+
+	size := cwn.n
+	dgst := w.Digest()
+	if err := w.Commit(ctx, size, dgst); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to commit squashed blob")
+	}
+
+	if err := SetBlobInfo(ctx, cs, BlobInfo{
+		Digest:      dgst,
+		DiffID:      diffDesc.Digest,
+		Size:        size,
+		Compression: compression,
+		MediaType:   c.OCIMediaType(),
+	}); err != nil {
+		return ocispec.Descriptor{}, DiffPair{}, errors.Wrap(err, "failed to record squashed layer info")
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: c.OCIMediaType(),
+		Digest:    dgst,
+		Size:      size,
+		Annotations: map[string]string{
+			uncompressedDiffIDAnnotation: diffDesc.Digest.String(),
+		},
+	}
+	dp := DiffPair{
+		DiffID:  diffDesc.Digest,
+		Blobsum: dgst,
+	}
+	return desc, dp, nil
+}
+
+// mountRef mounts ref read-only and returns its mounts along with a func
+// that releases the mount. ref may be nil, representing scratch, in which
+// case it returns an empty mount set and a no-op release.
+func mountRef(ctx context.Context, ref cache.ImmutableRef) ([]mount.Mount, func(), error) {
+	if ref == nil {
+		return nil, func() {}, nil
+	}
+
+	mountable, err := ref.Mount(ctx, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	mounts, release, err := mountable.Mount()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mounts, func() { release() }, nil
+}
@@ -0,0 +1,71 @@
+package blobs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResolveSquashCompressor(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		compression CompressionType
+		oci         bool
+		want        CompressionType
+	}{
+		{"oci zstd stays zstd", Zstd, true, Zstd},
+		{"docker zstd falls back to gzip", Zstd, false, Gzip},
+		{"docker gzip stays gzip", Gzip, false, Gzip},
+		{"oci gzip stays gzip", Gzip, true, Gzip},
+		{"oci uncompressed stays uncompressed", Uncompressed, true, Uncompressed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, c, err := resolveSquashCompressor(tt.compression, tt.oci)
+			if err != nil {
+				t.Fatalf("resolveSquashCompressor() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("resolveSquashCompressor() = %s, want %s", got, tt.want)
+			}
+			if c.Type() != tt.want {
+				t.Fatalf("resolved compressor type = %s, want %s", c.Type(), tt.want)
+			}
+			if !tt.oci && c.DockerMediaType() == "" {
+				t.Fatalf("resolved compressor %s has no docker media type for a docker-targeted squash", c.Type())
+			}
+		})
+	}
+}
+
+// TestCountingWriterTracksCompressedSize asserts that countingWriter reports
+// the number of bytes it actually wrote downstream, not the number of bytes
+// a compressing writer in front of it was fed -- those two differ for any
+// real compressor, which is what made compressSquashDiff commit a blob under
+// the wrong size.
+func TestCountingWriterTracksCompressedSize(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &countingWriter{w: &buf}
+
+	gz, err := getCompressor(Gzip)
+	if err != nil {
+		t.Fatalf("getCompressor(Gzip) error = %v", err)
+	}
+	w, err := gz.NewWriter(cw)
+	if err != nil {
+		t.Fatalf("NewWriter() error = %v", err)
+	}
+
+	uncompressed := bytes.Repeat([]byte("a"), 4096)
+	if _, err := w.Write(uncompressed); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if cw.n != int64(buf.Len()) {
+		t.Fatalf("countingWriter.n = %d, want %d (actual bytes written)", cw.n, buf.Len())
+	}
+	if cw.n == int64(len(uncompressed)) {
+		t.Fatalf("countingWriter.n = %d equals uncompressed size %d; compression had no effect on the count, the bug is back", cw.n, len(uncompressed))
+	}
+}